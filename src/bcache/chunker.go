@@ -0,0 +1,82 @@
+// Copyright 2020 Baidu, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package bcache
+
+import (
+	"math/rand"
+)
+
+const (
+	cdcWindowSize = 64         // bytes of rolling-hash history considered for a cut
+	cdcTargetBits = 16         // average chunk size is 2^cdcTargetBits == 64KiB
+	cdcMinSize    = 16 * 1024  // never cut smaller than this
+	cdcMaxSize    = 256 * 1024 // force a cut if we haven't found one by here
+)
+
+// buzhashTable is a fixed, deterministically-seeded permutation used by
+// the rolling hash below. It only needs to be stable across a single
+// process's lifetime, not across versions, since chunk digests (not the
+// rolling hash) are what's compared for dedup.
+var buzhashTable [256]uint32
+
+func init() {
+	src := rand.New(rand.NewSource(0x5be69a1f))
+	for i := range buzhashTable {
+		buzhashTable[i] = src.Uint32()
+	}
+}
+
+func rotateLeft32(x uint32, n uint) uint32 {
+	n %= 32
+	return (x << n) | (x >> (32 - n))
+}
+
+// cdcSplit cuts data into content-defined chunks using a buzhash rolling
+// hash: a cut lands wherever the hash of the last cdcWindowSize bytes
+// has its low cdcTargetBits all zero, bounded to [cdcMinSize,
+// cdcMaxSize]. Unlike fixed-size chunking, inserting or deleting bytes
+// only disturbs the chunks touching the edit, so unrelated shards that
+// share content still dedup against each other.
+func cdcSplit(data []byte) [][]byte {
+	if len(data) <= cdcMinSize {
+		return [][]byte{data}
+	}
+
+	var (
+		chunks [][]byte
+		start  int
+		h      uint32
+		mask   = uint32(1)<<cdcTargetBits - 1
+	)
+
+	for i, b := range data {
+		h = rotateLeft32(h, 1)
+		if size := i - start + 1; size > cdcWindowSize {
+			out := data[i-cdcWindowSize]
+			h ^= rotateLeft32(buzhashTable[out], cdcWindowSize)
+		}
+		h ^= buzhashTable[b]
+
+		size := i - start + 1
+		if size >= cdcMaxSize || (size >= cdcMinSize && h&mask == 0) {
+			chunks = append(chunks, data[start:i+1])
+			start = i + 1
+			h = 0
+		}
+	}
+	if start < len(data) {
+		chunks = append(chunks, data[start:])
+	}
+
+	return chunks
+}
@@ -0,0 +1,131 @@
+// Copyright 2020 Baidu, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package bcache
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"sync"
+)
+
+// ChunkRef names one content-defined chunk inside a ChunkStore, as
+// stored in a FileNode's manifest.
+type ChunkRef struct {
+	Digest [sha256.Size]byte
+	Length uint32
+}
+
+type chunkEntry struct {
+	data     []byte
+	refCount uint32
+}
+
+// ChunkStore deduplicates FileNode payloads that share content (e.g.
+// overlapping tar shards) by splitting them into content-defined chunks
+// and storing each distinct chunk once, reference-counted across every
+// FileNode that references it.
+type ChunkStore struct {
+	lock   sync.Mutex
+	chunks map[[sha256.Size]byte]*chunkEntry
+
+	logicalBytes uint64 // sum of chunk lengths across every Put, including dupes
+	storedBytes  uint64 // sum of chunk lengths actually held right now
+}
+
+// NewChunkStore creates an empty chunk store.
+func NewChunkStore() *ChunkStore {
+	return &ChunkStore{
+		chunks: make(map[[sha256.Size]byte]*chunkEntry),
+	}
+}
+
+// Put splits data with the content-defined chunker, stores any chunk
+// not already present, and bumps the refcount of ones that are. It
+// returns the manifest needed to reconstruct data via Get.
+func (s *ChunkStore) Put(data []byte) []ChunkRef {
+	pieces := cdcSplit(data)
+	manifest := make([]ChunkRef, 0, len(pieces))
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for _, piece := range pieces {
+		digest := sha256.Sum256(piece)
+		entry, ok := s.chunks[digest]
+		if !ok {
+			entry = &chunkEntry{data: append([]byte(nil), piece...)}
+			s.chunks[digest] = entry
+			s.storedBytes += uint64(len(piece))
+		}
+		entry.refCount++
+
+		manifest = append(manifest, ChunkRef{Digest: digest, Length: uint32(len(piece))})
+		s.logicalBytes += uint64(len(piece))
+	}
+
+	return manifest
+}
+
+// Get reconstructs the original bytes a manifest was built from.
+func (s *ChunkStore) Get(manifest []ChunkRef) ([]byte, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	var total int
+	for _, ref := range manifest {
+		total += int(ref.Length)
+	}
+
+	out := make([]byte, 0, total)
+	for _, ref := range manifest {
+		entry, ok := s.chunks[ref.Digest]
+		if !ok {
+			return nil, fmt.Errorf("chunk %x missing from store", ref.Digest)
+		}
+		out = append(out, entry.data...)
+	}
+	return out, nil
+}
+
+// Release drops one reference to every chunk in manifest, deleting any
+// chunk whose refcount reaches zero. Called when the FileNode that
+// manifest belongs to is evicted.
+func (s *ChunkStore) Release(manifest []ChunkRef) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for _, ref := range manifest {
+		entry, ok := s.chunks[ref.Digest]
+		if !ok {
+			continue
+		}
+		entry.refCount--
+		if entry.refCount == 0 {
+			s.storedBytes -= uint64(len(entry.data))
+			delete(s.chunks, ref.Digest)
+		}
+	}
+}
+
+// DedupRatio returns logicalBytes/storedBytes: how many times smaller
+// the store is than if every Put'd FileNode kept its own copy of every
+// chunk. Returns 1 when nothing has been stored yet.
+func (s *ChunkStore) DedupRatio() float64 {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.storedBytes == 0 {
+		return 1
+	}
+	return float64(s.logicalBytes) / float64(s.storedBytes)
+}
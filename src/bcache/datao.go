@@ -17,6 +17,7 @@ import (
 	"math/rand"
 	"sync"
 	"sync/atomic"
+	"time"
 )
 
 import (
@@ -49,6 +50,8 @@ type DLTGroup struct {
 	cachedFileNum     uint32   // don't contail unreaded files
 	cacheedFilesCache []uint32 // index to cachedFiles
 	cachedFiles       []uint32 // value is file id
+
+	policy EvictionPolicy // decides which cached file to give up as a substitute
 }
 
 type DLT struct {
@@ -58,6 +61,82 @@ type DLT struct {
 	readedFileNum uint32
 	groups        []DLTGroup
 	inited        bool
+
+	peers     *PeerPool     // nil unless this DLT is part of a multi-node deployment
+	backendSF *singleFlight // dedups concurrent readFromBackend calls for the same fileId
+
+	evictionPolicy EvictionPolicyKind // PolicyRandom unless SetEvictionPolicy is called before init
+
+	prefetchers []*Prefetcher // one per group, nil until StartPrefetching is called
+
+	negativeCache    *negativeLookupCache
+	negativeCacheTTL time.Duration // 0 means defaultNegativeCacheTTL
+
+	chunks       *ChunkStore // nil unless SetChunkStore is called, disabling dedup
+	manifestLock sync.Mutex
+	manifests    map[uint32][]ChunkRef // fileId -> chunk manifest, only populated when chunks != nil
+}
+
+// SetChunkStore attaches a ChunkStore so cached FileNode payloads are
+// split into content-defined chunks and deduplicated across fileIds
+// that share content, instead of each being cached whole. Must be
+// called before init.
+func (t *DLT) SetChunkStore(chunks *ChunkStore) {
+	t.chunks = chunks
+}
+
+// SetNegativeCacheTTL overrides how long a missing filename is
+// remembered before GetFileId is consulted again. Must be called
+// before init.
+func (t *DLT) SetNegativeCacheTTL(ttl time.Duration) {
+	t.negativeCacheTTL = ttl
+}
+
+// SetPeerPool attaches a cluster peer pool to this DLT. Once set, Get()
+// consults the peer that owns a missing fileId before falling back to
+// readFromBackend.
+func (t *DLT) SetPeerPool(peers *PeerPool) {
+	t.peers = peers
+}
+
+// SetEvictionPolicy picks which EvictionPolicy each group of this DLT
+// uses to choose a substitute file. Must be called before init.
+func (t *DLT) SetEvictionPolicy(kind EvictionPolicyKind) {
+	t.evictionPolicy = kind
+}
+
+// StartPrefetching launches a background Prefetcher for every group of
+// this DLT, each warming its cache with up to concurrency backend/peer
+// fetches in flight at once. Must be called after init.
+func (t *DLT) StartPrefetching(concurrency int) {
+	t.prefetchers = make([]*Prefetcher, len(t.groups))
+	for i := range t.groups {
+		p := NewPrefetcher(t, uint32(i), concurrency)
+		t.prefetchers[i] = p
+		p.Start()
+	}
+}
+
+// StopPrefetching stops every group's Prefetcher started by
+// StartPrefetching and waits for their in-flight fetches to drain.
+func (t *DLT) StopPrefetching() {
+	for _, p := range t.prefetchers {
+		p.Stop()
+	}
+	t.prefetchers = nil
+}
+
+// PrefetchMetrics returns the per-group Prefetcher metrics for this DLT,
+// indexed the same as t.groups. Entries are zero-valued for groups
+// without an active Prefetcher.
+func (t *DLT) PrefetchMetrics() []PrefetchMetrics {
+	metrics := make([]PrefetchMetrics, len(t.groups))
+	for i, p := range t.prefetchers {
+		if p != nil {
+			metrics[i] = p.Metrics()
+		}
+	}
+	return metrics
 }
 
 func (t *DLT) init(dataset *Dataset) error {
@@ -65,6 +144,9 @@ func (t *DLT) init(dataset *Dataset) error {
 		err error
 	)
 
+	t.backendSF = newSingleFlight()
+	t.negativeCache = newNegativeLookupCache(t.negativeCacheTTL)
+	t.manifests = make(map[uint32][]ChunkRef)
 	t.groups = make([]DLTGroup, dataset.groupNum)
 	for i := uint32(0); i < dataset.groupNum; i++ {
 		g := &(t.groups[i])
@@ -72,6 +154,7 @@ func (t *DLT) init(dataset *Dataset) error {
 		// init condition variable
 		g.cond = sync.NewCond(&g.lock)
 		g.dlt = t
+		g.policy = newEvictionPolicy(t.evictionPolicy)
 
 		g.group = &(dataset.groups[i])
 		g.readedFilesReal, err = utils.NewBitMap(g.group.fileNum)
@@ -108,9 +191,15 @@ func (t *DLT) Get(fileName string) (*FileNode, ErrorCode, error) {
 		return nil, CODE_DLT_NOT_INIT, nil
 	}
 
+	// a filename we already know doesn't resolve, skip the dataset index
+	if t.negativeCache.Get(fileName) {
+		return nil, CODE_NOT_FOUND, nil
+	}
+
 	// get file id
 	fileId, ok := t.dataset.GetFileId(fileName)
 	if !ok {
+		t.negativeCache.Put(fileName)
 		return nil, CODE_NOT_FOUND, nil
 	}
 
@@ -179,11 +268,11 @@ func (t *DLT) Get(fileName string) (*FileNode, ErrorCode, error) {
 			group.unreadFileNum--
 		}
 
-		// try to read from endpoint
+		// try to read from endpoint, a peer that already cached it first
 
 		lockReleased = true
 		group.lock.Unlock()
-		node, err = readFromBackend(t.dataset, t.id, t.dataset.id, group.group.id, tempId)
+		node, err = t.fetchFile(group.group.id, tempId)
 
 		// maybe , we can cache all files
 		if err != nil {
@@ -194,7 +283,7 @@ func (t *DLT) Get(fileName string) (*FileNode, ErrorCode, error) {
 		if group.group.allowCacheSize >= group.group.cachedSize {
 			lockReleased = false
 			group.lock.Lock()
-			t.dataset.cachedFiles[tempId] = node
+			t.cacheNode(tempId, node)
 			group.readedCachedFiles[group.readedCachedFileNum] = tempId
 			group.readedCachedFileNum++
 		}
@@ -223,6 +312,115 @@ func (t *DLT) Get(fileName string) (*FileNode, ErrorCode, error) {
 	return nil, CODE_EMPTY, fmt.Errorf("don't have unread file, when try to read %d", fileId)
 }
 
+// fetchFile resolves fileId by checking the owning peer first (if this
+// DLT is part of a multi-node deployment) and only falling back to the
+// backend when no peer has it cached. Concurrent callers for the same
+// fileId are deduplicated, whether the fetch ends up going to a peer or
+// to the backend.
+func (t *DLT) fetchFile(groupId, fileId uint32) (*FileNode, error) {
+	if t.peers != nil {
+		node, hit, err := t.peers.Fetch(t.dataset.id, t.id, groupId, fileId)
+		if err != nil {
+			return nil, err
+		}
+		if hit {
+			return node, nil
+		}
+	}
+
+	key := fmt.Sprintf("%d-%d", groupId, fileId)
+	return t.backendSF.Do(key, func() (*FileNode, error) {
+		return readFromBackend(t.dataset, t.id, t.dataset.id, groupId, fileId)
+	})
+}
+
+// cacheNode records node as cached under fileId. When a ChunkStore is
+// attached, node's payload is split and deduplicated there instead of
+// being held a second time in cachedFiles: only a shell FileNode (its
+// fileId, no data) is stored, and getFileFromCache reconstructs the
+// real payload from the manifest on the way out. This is what lets a
+// fixed allowCacheSize hold more distinct files when shards overlap.
+func (t *DLT) cacheNode(fileId uint32, node *FileNode) {
+	if t.chunks == nil {
+		t.dataset.cachedFiles[fileId] = node
+		return
+	}
+
+	manifest := t.chunks.Put(node.data)
+
+	t.manifestLock.Lock()
+	t.manifests[fileId] = manifest
+	t.manifestLock.Unlock()
+
+	t.dataset.cachedFiles[fileId] = &FileNode{fileId: node.fileId}
+}
+
+// reconstructNode returns node ready to hand back to a caller: as-is if
+// no ChunkStore is attached (or this fileId predates one), otherwise
+// with its data rebuilt from the chunk manifest cacheNode recorded.
+func (t *DLT) reconstructNode(fileId uint32, node *FileNode) (*FileNode, error) {
+	if t.chunks == nil {
+		return node, nil
+	}
+
+	t.manifestLock.Lock()
+	manifest, ok := t.manifests[fileId]
+	t.manifestLock.Unlock()
+	if !ok {
+		return node, nil
+	}
+
+	data, err := t.chunks.Get(manifest)
+	if err != nil {
+		return nil, err
+	}
+	return &FileNode{fileId: node.fileId, data: data}, nil
+}
+
+// releaseNode drops fileId's chunk references, if any were recorded by
+// cacheNode. Called once fileId leaves a group's servable cache pool.
+func (t *DLT) releaseNode(fileId uint32) {
+	if t.chunks == nil {
+		return
+	}
+
+	t.manifestLock.Lock()
+	manifest, ok := t.manifests[fileId]
+	if ok {
+		delete(t.manifests, fileId)
+	}
+	t.manifestLock.Unlock()
+
+	if ok {
+		t.chunks.Release(manifest)
+	}
+}
+
+// DedupRatio reports how much chunk sharing has saved this DLT's cache,
+// or 1 if no ChunkStore is attached.
+func (t *DLT) DedupRatio() float64 {
+	if t.chunks == nil {
+		return 1
+	}
+	return t.chunks.DedupRatio()
+}
+
+// hasCachedData reports whether fileId's payload is actually available
+// in process memory right now: a manifest in t.manifests when a
+// ChunkStore is attached, or a live entry in dataset.cachedFiles
+// otherwise. Persist only snapshots bookkeeping, never the payloads
+// themselves, so Restore uses this to tell a real cache hit from
+// bookkeeping that outlived a process restart.
+func (t *DLT) hasCachedData(fileId uint32) bool {
+	if t.chunks != nil {
+		t.manifestLock.Lock()
+		_, ok := t.manifests[fileId]
+		t.manifestLock.Unlock()
+		return ok
+	}
+	return t.dataset.cachedFiles[fileId] != nil
+}
+
 // for batfs
 func (t *DLT) getFileFromCache(fileId uint32, group *DLTGroup) (*FileNode, error) {
 	var (
@@ -242,6 +440,7 @@ func (t *DLT) getFileFromCache(fileId uint32, group *DLTGroup) (*FileNode, error
 			return nil, fmt.Errorf("can't get cached file")
 		}
 	} else {
+		group.policy.OnAccess(fileId)
 		group.markCachedFileReaded(fileId, val-1)
 	}
 
@@ -251,14 +450,22 @@ func (t *DLT) getFileFromCache(fileId uint32, group *DLTGroup) (*FileNode, error
 		return nil, fmt.Errorf("file %d is mark as cached , but not cached", tempId)
 	}
 
-	return node, nil
+	rebuilt, err := t.reconstructNode(tempId, node)
+	// tempId has left the servable pool above; its chunk references are
+	// dropped only now that its payload has been rebuilt from them
+	t.releaseNode(tempId)
+	return rebuilt, err
 }
 
-// must have enough cache
+// must have enough cache; asks the group's EvictionPolicy which cached
+// file to give up rather than picking uniformly at random
 func (g *DLTGroup) getRandomCachedFile() (uint32, bool) {
-	randNum := rand.Uint32() % g.cachedFileNum
-	fileId := g.cachedFiles[randNum]
-	g.markCachedFileReaded(fileId, randNum)
+	fileId, ok := g.policy.Victim()
+	if !ok {
+		return 0, false
+	}
+	index := g.cacheedFilesCache[fileId] - 1
+	g.markCachedFileReaded(fileId, index)
 	return fileId, true
 }
 
@@ -278,6 +485,7 @@ func (g *DLTGroup) markCachedFileReaded(fileId, index uint32) {
 	// mark this file is readed
 	g.cacheedFilesCache[fileId] = 0
 	g.cachedFileNum--
+	g.policy.OnRemove(fileId)
 }
 
 // on condition that cache is empty
@@ -304,6 +512,30 @@ func (g *DLTGroup) getRandomUnreadedFile() (uint32, bool) {
 	return fileId, true
 }
 
+// popUnreadForPreread removes fileId from unreadFiles and marks it as
+// claimed by the background Prefetcher (counted in prereadFileNum
+// instead). Returns false if fileId isn't sitting in unreadFiles
+// anymore, e.g. a concurrent Get() already claimed it directly.
+func (g *DLTGroup) popUnreadForPreread(fileId uint32) bool {
+	stored := g.unreadFilesIndexs[fileId]
+	if stored == 0 {
+		return false
+	}
+	index := stored - 1
+
+	lastId := g.unreadFileNum - 1
+	if index != lastId {
+		g.unreadFiles[index] = g.unreadFiles[lastId]
+		g.unreadFilesIndexs[g.unreadFiles[index]] = index + 1
+	}
+
+	g.unreadFilesIndexs[fileId] = 0
+	g.unreadFileNum--
+	g.prereadFileNum++
+
+	return true
+}
+
 // add file to unread files
 func (g *DLTGroup) addUnreadedFile(fileId uint32) {
 	index := g.unreadFilesIndexs[fileId]
@@ -356,6 +588,7 @@ func (g *DLTGroup) addFileToCache(node *FileNode) {
 		g.cachedFiles[g.cachedFileNum] = fileId
 		g.cachedFileNum++
 		g.cacheedFilesCache[fileId] = g.cachedFileNum
+		g.policy.OnInsert(fileId)
 
 		if atomic.LoadInt32(&g.hasWiated) > 0 {
 			g.cond.Signal()
@@ -364,3 +597,33 @@ func (g *DLTGroup) addFileToCache(node *FileNode) {
 		fmt.Println("Wraning: file %d has been cached", fileId)
 	}
 }
+
+// evictUnbackedCachedFiles drops every fileId this group believes is
+// cached but whose payload isn't actually present (per
+// DLT.hasCachedData), putting it back in unreadFiles instead. Restore
+// calls this after loading a snapshot's bookkeeping, since Persist never
+// captures the cached payloads themselves - only Restore can tell which
+// restored entries are real and which are stale claims left over from
+// the process that wrote the snapshot.
+func (g *DLTGroup) evictUnbackedCachedFiles() {
+	stale := append([]uint32(nil), g.cachedFiles[:g.cachedFileNum]...)
+	for _, fileId := range stale {
+		if g.dlt.hasCachedData(fileId) {
+			continue
+		}
+
+		index := g.cacheedFilesCache[fileId] - 1
+		lastId := g.cachedFileNum - 1
+		if index != lastId {
+			g.cachedFiles[index] = g.cachedFiles[lastId]
+			g.cacheedFilesCache[g.cachedFiles[index]] = index + 1
+		}
+		g.cacheedFilesCache[fileId] = 0
+		g.cachedFileNum--
+		g.policy.OnRemove(fileId)
+
+		g.unreadFiles[g.unreadFileNum] = fileId
+		g.unreadFileNum++
+		g.unreadFilesIndexs[fileId] = g.unreadFileNum
+	}
+}
@@ -0,0 +1,334 @@
+// Copyright 2020 Baidu, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package bcache
+
+import (
+	"container/list"
+	"math/rand"
+)
+
+// EvictionPolicyKind selects which EvictionPolicy implementation a
+// DLTGroup uses to pick a substitute file when the one actually
+// requested isn't cached.
+type EvictionPolicyKind int
+
+const (
+	PolicyRandom EvictionPolicyKind = iota
+	PolicyLRU
+	PolicyLFU
+)
+
+// EvictionPolicy tracks which fileIds are currently cached for a
+// DLTGroup and decides which one to give up when a substitute is
+// needed. OnInsert/OnRemove keep the policy's bookkeeping in sync with
+// cachedFiles; OnAccess records a hit so LRU/LFU can favor shards that
+// keep getting reused across epochs.
+type EvictionPolicy interface {
+	OnInsert(fileId uint32)
+	OnAccess(fileId uint32)
+	OnRemove(fileId uint32)
+	Victim() (fileId uint32, ok bool)
+
+	// Snapshot returns every tracked fileId in next-victim-first order,
+	// each paired with its current hit count (0 where a policy doesn't
+	// track frequency). Restore rebuilds that exact state, so
+	// Persist/Restore can survive a process restart without falling
+	// back to plain insertion order.
+	Snapshot() []PolicyEntry
+	Restore(entries []PolicyEntry)
+}
+
+// PolicyEntry is one fileId's position in an EvictionPolicy's
+// bookkeeping, as captured by Snapshot.
+type PolicyEntry struct {
+	FileId uint32
+	Freq   uint32
+}
+
+func newEvictionPolicy(kind EvictionPolicyKind) EvictionPolicy {
+	switch kind {
+	case PolicyLRU:
+		return newLRUPolicy()
+	case PolicyLFU:
+		return newLFUPolicy()
+	default:
+		return newRandomPolicy()
+	}
+}
+
+// RandomPolicy picks a victim uniformly at random, matching the cache's
+// original replacement behavior.
+type RandomPolicy struct {
+	index map[uint32]int // fileId -> position in ids
+	ids   []uint32
+}
+
+func newRandomPolicy() *RandomPolicy {
+	return &RandomPolicy{index: make(map[uint32]int)}
+}
+
+func (p *RandomPolicy) OnInsert(fileId uint32) {
+	if _, ok := p.index[fileId]; ok {
+		return
+	}
+	p.index[fileId] = len(p.ids)
+	p.ids = append(p.ids, fileId)
+}
+
+func (p *RandomPolicy) OnAccess(fileId uint32) {}
+
+func (p *RandomPolicy) OnRemove(fileId uint32) {
+	idx, ok := p.index[fileId]
+	if !ok {
+		return
+	}
+	last := len(p.ids) - 1
+	if idx != last {
+		p.ids[idx] = p.ids[last]
+		p.index[p.ids[idx]] = idx
+	}
+	p.ids = p.ids[:last]
+	delete(p.index, fileId)
+}
+
+func (p *RandomPolicy) Victim() (uint32, bool) {
+	if len(p.ids) == 0 {
+		return 0, false
+	}
+	return p.ids[rand.Uint32()%uint32(len(p.ids))], true
+}
+
+func (p *RandomPolicy) Snapshot() []PolicyEntry {
+	entries := make([]PolicyEntry, len(p.ids))
+	for i, fileId := range p.ids {
+		entries[i] = PolicyEntry{FileId: fileId}
+	}
+	return entries
+}
+
+func (p *RandomPolicy) Restore(entries []PolicyEntry) {
+	p.index = make(map[uint32]int, len(entries))
+	p.ids = p.ids[:0]
+	for _, e := range entries {
+		p.OnInsert(e.FileId)
+	}
+}
+
+// LRUPolicy evicts the least-recently-accessed fileId first.
+type LRUPolicy struct {
+	entries map[uint32]*list.Element
+	order   *list.List // front = most recently used, back = victim
+}
+
+func newLRUPolicy() *LRUPolicy {
+	return &LRUPolicy{
+		entries: make(map[uint32]*list.Element),
+		order:   list.New(),
+	}
+}
+
+func (p *LRUPolicy) OnInsert(fileId uint32) {
+	if _, ok := p.entries[fileId]; ok {
+		return
+	}
+	p.entries[fileId] = p.order.PushFront(fileId)
+}
+
+func (p *LRUPolicy) OnAccess(fileId uint32) {
+	if elem, ok := p.entries[fileId]; ok {
+		p.order.MoveToFront(elem)
+	}
+}
+
+func (p *LRUPolicy) OnRemove(fileId uint32) {
+	if elem, ok := p.entries[fileId]; ok {
+		p.order.Remove(elem)
+		delete(p.entries, fileId)
+	}
+}
+
+func (p *LRUPolicy) Victim() (uint32, bool) {
+	back := p.order.Back()
+	if back == nil {
+		return 0, false
+	}
+	return back.Value.(uint32), true
+}
+
+// Snapshot walks back-to-front, i.e. next victim (least recently used)
+// first, matching the next-victim-first contract.
+func (p *LRUPolicy) Snapshot() []PolicyEntry {
+	entries := make([]PolicyEntry, 0, p.order.Len())
+	for e := p.order.Back(); e != nil; e = e.Prev() {
+		entries = append(entries, PolicyEntry{FileId: e.Value.(uint32)})
+	}
+	return entries
+}
+
+// Restore replays entries oldest (least recently used) to newest, since
+// OnInsert always pushes to the front, so the resulting order matches
+// what Snapshot recorded.
+func (p *LRUPolicy) Restore(entries []PolicyEntry) {
+	p.entries = make(map[uint32]*list.Element, len(entries))
+	p.order.Init()
+	for _, e := range entries {
+		p.OnInsert(e.FileId)
+	}
+}
+
+// lfuEntry is one cached fileId living inside a frequency bucket.
+type lfuEntry struct {
+	fileId uint32
+	freq   uint32
+	bucket *list.Element // the freqBucket this entry currently lives in
+}
+
+// freqBucket groups every entry that has been accessed exactly freq
+// times, so Victim can grab the head of the lowest-frequency bucket in
+// O(1) instead of scanning for the minimum.
+type freqBucket struct {
+	freq    uint32
+	entries *list.List // of *lfuEntry
+}
+
+// LFUPolicy is an O(1) LFU cache as described by Ketan Shah et al.: a
+// doubly-linked list of frequency buckets, each holding an intrusive
+// list of entries that share that hit count.
+type LFUPolicy struct {
+	entries map[uint32]*list.Element // fileId -> element in its bucket's list
+	buckets *list.List               // of *freqBucket, ascending freq
+}
+
+func newLFUPolicy() *LFUPolicy {
+	return &LFUPolicy{
+		entries: make(map[uint32]*list.Element),
+		buckets: list.New(),
+	}
+}
+
+func (p *LFUPolicy) OnInsert(fileId uint32) {
+	if _, ok := p.entries[fileId]; ok {
+		return
+	}
+
+	front := p.buckets.Front()
+	var bucketElem *list.Element
+	if front == nil || front.Value.(*freqBucket).freq != 1 {
+		bucketElem = p.buckets.PushFront(&freqBucket{freq: 1, entries: list.New()})
+	} else {
+		bucketElem = front
+	}
+
+	bucket := bucketElem.Value.(*freqBucket)
+	entry := &lfuEntry{fileId: fileId, freq: 1, bucket: bucketElem}
+	p.entries[fileId] = bucket.entries.PushBack(entry)
+}
+
+func (p *LFUPolicy) OnAccess(fileId uint32) {
+	elem, ok := p.entries[fileId]
+	if !ok {
+		return
+	}
+	entry := elem.Value.(*lfuEntry)
+	bucketElem := entry.bucket
+	bucket := bucketElem.Value.(*freqBucket)
+
+	bucket.entries.Remove(elem)
+	entry.freq++
+
+	next := bucketElem.Next()
+	var nextBucketElem *list.Element
+	if next == nil || next.Value.(*freqBucket).freq != entry.freq {
+		nextBucketElem = p.buckets.InsertAfter(&freqBucket{freq: entry.freq, entries: list.New()}, bucketElem)
+	} else {
+		nextBucketElem = next
+	}
+
+	nextBucket := nextBucketElem.Value.(*freqBucket)
+	entry.bucket = nextBucketElem
+	p.entries[fileId] = nextBucket.entries.PushBack(entry)
+
+	if bucket.entries.Len() == 0 {
+		p.buckets.Remove(bucketElem)
+	}
+}
+
+func (p *LFUPolicy) OnRemove(fileId uint32) {
+	elem, ok := p.entries[fileId]
+	if !ok {
+		return
+	}
+	entry := elem.Value.(*lfuEntry)
+	bucket := entry.bucket.Value.(*freqBucket)
+
+	bucket.entries.Remove(elem)
+	delete(p.entries, fileId)
+	if bucket.entries.Len() == 0 {
+		p.buckets.Remove(entry.bucket)
+	}
+}
+
+func (p *LFUPolicy) Victim() (uint32, bool) {
+	front := p.buckets.Front()
+	if front == nil {
+		return 0, false
+	}
+	bucket := front.Value.(*freqBucket)
+	head := bucket.entries.Front()
+	if head == nil {
+		return 0, false
+	}
+	return head.Value.(*lfuEntry).fileId, true
+}
+
+// Snapshot walks buckets lowest-freq to highest (next victim first),
+// recording each entry's real hit count so Restore doesn't lose it.
+func (p *LFUPolicy) Snapshot() []PolicyEntry {
+	var entries []PolicyEntry
+	for b := p.buckets.Front(); b != nil; b = b.Next() {
+		bucket := b.Value.(*freqBucket)
+		for e := bucket.entries.Front(); e != nil; e = e.Next() {
+			entry := e.Value.(*lfuEntry)
+			entries = append(entries, PolicyEntry{FileId: entry.fileId, Freq: entry.freq})
+		}
+	}
+	return entries
+}
+
+// Restore rebuilds the bucket list directly from entries' recorded
+// frequencies, rather than replaying OnInsert (which would flatten
+// every entry back down to freq 1). entries must be in the ascending
+// freq order Snapshot produces.
+func (p *LFUPolicy) Restore(entries []PolicyEntry) {
+	p.entries = make(map[uint32]*list.Element, len(entries))
+	p.buckets.Init()
+
+	for _, e := range entries {
+		freq := e.Freq
+		if freq == 0 {
+			freq = 1
+		}
+
+		back := p.buckets.Back()
+		var bucketElem *list.Element
+		if back == nil || back.Value.(*freqBucket).freq != freq {
+			bucketElem = p.buckets.PushBack(&freqBucket{freq: freq, entries: list.New()})
+		} else {
+			bucketElem = back
+		}
+
+		bucket := bucketElem.Value.(*freqBucket)
+		entry := &lfuEntry{fileId: e.FileId, freq: freq, bucket: bucketElem}
+		p.entries[e.FileId] = bucket.entries.PushBack(entry)
+	}
+}
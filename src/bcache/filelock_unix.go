@@ -0,0 +1,61 @@
+// Copyright 2020 Baidu, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+//go:build !windows
+// +build !windows
+
+package bcache
+
+import (
+	"os"
+	"syscall"
+)
+
+// fileLock is an advisory cross-process lock backed by flock(2), held
+// for as long as the underlying file stays open.
+//
+// flock(2) rather than fcntl(2)/F_SETLK: Persist/Restore only ever take
+// one lock per snapshot file per *os.File, and flock's whole-file,
+// not-per-process-and-fd semantics are simpler to reason about here -
+// fcntl locks are released the moment any fd for the file closes
+// anywhere in the process, which doesn't fit a lock meant to be held for
+// the scope of a single fileLock value.
+type fileLock struct {
+	f *os.File
+}
+
+// lockFile opens (creating if needed) the file at path and blocks until
+// it acquires a shared (exclusive=false) or exclusive lock on it.
+func lockFile(path string, exclusive bool) (*fileLock, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	how := syscall.LOCK_SH
+	if exclusive {
+		how = syscall.LOCK_EX
+	}
+	if err := syscall.Flock(int(f.Fd()), how); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return &fileLock{f: f}, nil
+}
+
+// Unlock releases the lock and closes the underlying file.
+func (l *fileLock) Unlock() error {
+	err := syscall.Flock(int(l.f.Fd()), syscall.LOCK_UN)
+	l.f.Close()
+	return err
+}
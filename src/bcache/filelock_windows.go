@@ -0,0 +1,57 @@
+// Copyright 2020 Baidu, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+//go:build windows
+// +build windows
+
+package bcache
+
+import (
+	"os"
+	"syscall"
+)
+
+// fileLock is an advisory cross-process lock backed by LockFileEx, held
+// for as long as the underlying file stays open.
+type fileLock struct {
+	f *os.File
+}
+
+// lockFile opens (creating if needed) the file at path and blocks until
+// it acquires a shared (exclusive=false) or exclusive lock on it.
+func lockFile(path string, exclusive bool) (*fileLock, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	var flags uint32
+	if exclusive {
+		flags = syscall.LOCKFILE_EXCLUSIVE_LOCK
+	}
+
+	overlapped := new(syscall.Overlapped)
+	if err := syscall.LockFileEx(syscall.Handle(f.Fd()), flags, 0, 1, 0, overlapped); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return &fileLock{f: f}, nil
+}
+
+// Unlock releases the lock and closes the underlying file.
+func (l *fileLock) Unlock() error {
+	overlapped := new(syscall.Overlapped)
+	err := syscall.UnlockFileEx(syscall.Handle(l.f.Fd()), 0, 1, 0, overlapped)
+	l.f.Close()
+	return err
+}
@@ -0,0 +1,105 @@
+// Copyright 2020 Baidu, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package bcache
+
+import (
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"sync"
+)
+
+const (
+	// default number of virtual nodes per physical peer
+	defaultReplicas = 160
+)
+
+// hashRing is a consistent-hash ring used to pick the peer that owns a
+// given fileId. Each peer is hashed onto replicas virtual nodes so that
+// adding or removing a peer only reshuffles a small fraction of the keys.
+type hashRing struct {
+	lock     sync.RWMutex
+	replicas int
+	nodes    []uint32          // sorted virtual node hashes
+	owners   map[uint32]string // virtual node hash -> peer addr
+}
+
+func newHashRing(replicas int) *hashRing {
+	if replicas <= 0 {
+		replicas = defaultReplicas
+	}
+	return &hashRing{
+		replicas: replicas,
+		owners:   make(map[uint32]string),
+	}
+}
+
+// hashKey uses FNV-1a rather than xxhash: it's in the standard library,
+// so the ring doesn't pull in a new dependency for this tree, and ring
+// placement only needs a well-distributed hash, not xxhash's extra
+// throughput (which matters for hashing large payloads, not short
+// "peer#n"/fileId keys).
+func hashKey(key string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return h.Sum32()
+}
+
+// Add registers a peer, inserting replicas virtual nodes for it.
+func (r *hashRing) Add(peer string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	for i := 0; i < r.replicas; i++ {
+		vnode := hashKey(fmt.Sprintf("%s#%d", peer, i))
+		if _, ok := r.owners[vnode]; ok {
+			continue
+		}
+		r.owners[vnode] = peer
+		r.nodes = append(r.nodes, vnode)
+	}
+	sort.Slice(r.nodes, func(i, j int) bool { return r.nodes[i] < r.nodes[j] })
+}
+
+// Remove drops a peer and all of its virtual nodes from the ring.
+func (r *hashRing) Remove(peer string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	kept := r.nodes[:0]
+	for _, vnode := range r.nodes {
+		if r.owners[vnode] == peer {
+			delete(r.owners, vnode)
+			continue
+		}
+		kept = append(kept, vnode)
+	}
+	r.nodes = kept
+}
+
+// Owner walks the ring clockwise from fileId and returns the owning peer.
+func (r *hashRing) Owner(fileId uint32) (string, bool) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	if len(r.nodes) == 0 {
+		return "", false
+	}
+
+	h := hashKey(fmt.Sprintf("%d", fileId))
+	idx := sort.Search(len(r.nodes), func(i int) bool { return r.nodes[i] >= h })
+	if idx == len(r.nodes) {
+		idx = 0
+	}
+	return r.owners[r.nodes[idx]], true
+}
@@ -0,0 +1,68 @@
+// Copyright 2020 Baidu, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package bcache
+
+import (
+	"sync"
+	"time"
+)
+
+// defaultNegativeCacheTTL bounds how long a missing filename stays
+// cached as "not found" before GetFileId is consulted again, in case
+// the dataset index catches up.
+const defaultNegativeCacheTTL = 30 * time.Second
+
+// negativeLookupCache remembers filenames that GetFileId couldn't
+// resolve, so repeated lookups of the same bogus filename (a common
+// pattern when a caller retries a typo'd path) don't keep re-querying
+// the dataset index.
+type negativeLookupCache struct {
+	lock    sync.Mutex
+	ttl     time.Duration
+	entries map[string]time.Time // filename -> expiry
+}
+
+func newNegativeLookupCache(ttl time.Duration) *negativeLookupCache {
+	if ttl <= 0 {
+		ttl = defaultNegativeCacheTTL
+	}
+	return &negativeLookupCache{
+		ttl:     ttl,
+		entries: make(map[string]time.Time),
+	}
+}
+
+// Get reports whether fileName is a known-missing lookup that hasn't
+// expired yet.
+func (c *negativeLookupCache) Get(fileName string) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	expiry, ok := c.entries[fileName]
+	if !ok {
+		return false
+	}
+	if time.Now().After(expiry) {
+		delete(c.entries, fileName)
+		return false
+	}
+	return true
+}
+
+// Put records fileName as missing for the cache's TTL.
+func (c *negativeLookupCache) Put(fileName string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.entries[fileName] = time.Now().Add(c.ttl)
+}
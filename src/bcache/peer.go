@@ -0,0 +1,169 @@
+// Copyright 2020 Baidu, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package bcache
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// RPCScheme selects the transport a PeerPool uses to talk to other cache
+// nodes. Both sides of a deployment must agree on the same scheme.
+//
+// Only SchemeHTTP is implemented today. A gRPC transport was sketched out
+// but never wired up - there's no peer server package in this tree to
+// hand it a client - so it was dropped rather than left as a scheme that
+// always errors.
+type RPCScheme string
+
+const (
+	SchemeHTTP RPCScheme = "http"
+)
+
+// Peer is a single remote cache node that may already hold the FileNode
+// we're looking for.
+type Peer interface {
+	Addr() string
+	FetchFile(datasetId, dltId, groupId, fileId uint32) (node *FileNode, hit bool, err error)
+}
+
+// PeerPool owns the consistent-hash ring of peer cache nodes and
+// deduplicates concurrent fetches for the same fileId.
+type PeerPool struct {
+	ring   *hashRing
+	sf     *singleFlight
+	scheme RPCScheme
+
+	lock  sync.RWMutex
+	peers map[string]Peer
+}
+
+// NewPeerPool creates an empty peer pool talking over the given scheme.
+func NewPeerPool(scheme RPCScheme) *PeerPool {
+	if scheme == "" {
+		scheme = SchemeHTTP
+	}
+	return &PeerPool{
+		ring:   newHashRing(defaultReplicas),
+		sf:     newSingleFlight(),
+		scheme: scheme,
+		peers:  make(map[string]Peer),
+	}
+}
+
+// RegisterPeers replaces the pool's peer set with addrs, rebuilding the
+// hash ring from scratch. addrs are host:port strings of other cache
+// nodes in the cluster.
+func (p *PeerPool) RegisterPeers(addrs []string) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	ring := newHashRing(defaultReplicas)
+	peers := make(map[string]Peer, len(addrs))
+	for _, addr := range addrs {
+		peer, err := newPeerClient(p.scheme, addr)
+		if err != nil {
+			return err
+		}
+		peers[addr] = peer
+		ring.Add(addr)
+	}
+
+	p.ring = ring
+	p.peers = peers
+	return nil
+}
+
+// PickPeer returns the peer that owns fileId according to the consistent
+// hash ring, or ok=false if the pool has no peers registered.
+func (p *PeerPool) PickPeer(fileId uint32) (Peer, bool) {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+
+	addr, ok := p.ring.Owner(fileId)
+	if !ok {
+		return nil, false
+	}
+	peer, ok := p.peers[addr]
+	return peer, ok
+}
+
+// Fetch asks the owning peer for fileId, deduplicating concurrent
+// requests for the same (datasetId, dltId, groupId, fileId) tuple.
+func (p *PeerPool) Fetch(datasetId, dltId, groupId, fileId uint32) (*FileNode, bool, error) {
+	peer, ok := p.PickPeer(fileId)
+	if !ok {
+		return nil, false, nil
+	}
+
+	key := fmt.Sprintf("%d-%d-%d-%d", datasetId, dltId, groupId, fileId)
+	node, err := p.sf.Do(key, func() (*FileNode, error) {
+		node, hit, err := peer.FetchFile(datasetId, dltId, groupId, fileId)
+		if err != nil || !hit {
+			return nil, err
+		}
+		return node, nil
+	})
+	return node, node != nil, err
+}
+
+func newPeerClient(scheme RPCScheme, addr string) (Peer, error) {
+	switch scheme {
+	case SchemeHTTP:
+		return &httpPeer{addr: addr, client: &http.Client{Timeout: 5 * time.Second}}, nil
+	default:
+		return nil, fmt.Errorf("unknown peer rpc scheme %q", scheme)
+	}
+}
+
+// httpPeer fetches FileNodes from another cache node's bcache HTTP
+// endpoint, gob-encoded on the wire.
+type httpPeer struct {
+	addr   string
+	client *http.Client
+}
+
+func (p *httpPeer) Addr() string { return p.addr }
+
+func (p *httpPeer) FetchFile(datasetId, dltId, groupId, fileId uint32) (*FileNode, bool, error) {
+	url := fmt.Sprintf("http://%s/bcache/peer/fetch?dataset=%d&dlt=%d&group=%d&file=%d",
+		p.addr, datasetId, dltId, groupId, fileId)
+
+	resp, err := p.client.Get(url)
+	if err != nil {
+		return nil, false, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, false, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, false, fmt.Errorf("peer %s returned status %d", p.addr, resp.StatusCode)
+	}
+
+	var buf bytes.Buffer
+	if _, err := buf.ReadFrom(resp.Body); err != nil {
+		return nil, false, err
+	}
+
+	node := new(FileNode)
+	if err := gob.NewDecoder(&buf).Decode(node); err != nil {
+		return nil, false, err
+	}
+	return node, true, nil
+}
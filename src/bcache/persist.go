@@ -0,0 +1,188 @@
+// Copyright 2020 Baidu, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package bcache
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+import (
+	"utils"
+)
+
+// groupSnapshot is the on-disk form of one DLTGroup: enough bookkeeping
+// to rebuild cachedFiles/unreadFiles membership and the two bitmaps
+// without replaying every Get() call since the last restart.
+type groupSnapshot struct {
+	ReadedFilesReal  []byte
+	ReadedFilesCache []byte
+
+	UnreadFileNum     uint32
+	UnreadFiles       []uint32
+	UnreadFilesIndexs []uint32
+
+	ReadedCachedFileNum uint32
+	ReadedCachedFiles   []uint32
+
+	PrereadFileNum uint32
+
+	CachedFileNum     uint32
+	CacheedFilesCache []uint32
+	CachedFiles       []uint32
+
+	Policy []PolicyEntry
+}
+
+// dltSnapshot is the on-disk form of one DLT: its groups plus the
+// counters init sets up.
+type dltSnapshot struct {
+	DLTId         uint32
+	FileNum       uint32
+	ReadedFileNum uint32
+	Groups        []groupSnapshot
+}
+
+func snapshotPath(dir string, dltId uint32) string {
+	return filepath.Join(dir, fmt.Sprintf("dlt-%d.gob", dltId))
+}
+
+// Persist serializes t's cache topology - which fileIds are cached, per
+// group bitmaps, unread/preread bookkeeping - to dir, so a process
+// restart can skip paying the cache warmup cost again via Restore.
+// Writes are guarded by an exclusive file lock so two processes sharing
+// dir can't interleave and corrupt the snapshot.
+func Persist(t *DLT, dir string) error {
+	if !t.inited {
+		return fmt.Errorf("dlt %d not inited, nothing to persist", t.id)
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	snap := dltSnapshot{
+		DLTId:         t.id,
+		FileNum:       t.fileNum,
+		ReadedFileNum: t.readedFileNum,
+		Groups:        make([]groupSnapshot, len(t.groups)),
+	}
+
+	for i := range t.groups {
+		g := &t.groups[i]
+		g.lock.Lock()
+		snap.Groups[i] = groupSnapshot{
+			ReadedFilesReal:     g.readedFilesReal.Bytes(),
+			ReadedFilesCache:    g.readedFilesCache.Bytes(),
+			UnreadFileNum:       g.unreadFileNum,
+			UnreadFiles:         append([]uint32(nil), g.unreadFiles...),
+			UnreadFilesIndexs:   append([]uint32(nil), g.unreadFilesIndexs...),
+			ReadedCachedFileNum: g.readedCachedFileNum,
+			ReadedCachedFiles:   append([]uint32(nil), g.readedCachedFiles...),
+			PrereadFileNum:      g.prereadFileNum,
+			CachedFileNum:       g.cachedFileNum,
+			CacheedFilesCache:   append([]uint32(nil), g.cacheedFilesCache...),
+			CachedFiles:         append([]uint32(nil), g.cachedFiles...),
+			Policy:              g.policy.Snapshot(),
+		}
+		g.lock.Unlock()
+	}
+
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(&snap); err != nil {
+		return err
+	}
+
+	path := snapshotPath(dir, t.id)
+	lock, err := lockFile(path+".lock", true)
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+
+	return os.WriteFile(path, buf.Bytes(), 0644)
+}
+
+// Restore loads a snapshot written by Persist back into t. t must
+// already be inited against a dataset with the same group layout the
+// snapshot was taken from. Reads are guarded by a shared file lock, so
+// Restore can run concurrently with other readers (but not a writer).
+func Restore(t *DLT, dir string) error {
+	if !t.inited {
+		return fmt.Errorf("dlt %d not inited, can't restore", t.id)
+	}
+
+	path := snapshotPath(dir, t.id)
+	lock, err := lockFile(path+".lock", false)
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	var snap dltSnapshot
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&snap); err != nil {
+		return err
+	}
+
+	if len(snap.Groups) != len(t.groups) {
+		return fmt.Errorf("snapshot has %d groups, dlt %d has %d", len(snap.Groups), t.id, len(t.groups))
+	}
+
+	t.readedFileNum = snap.ReadedFileNum
+
+	for i := range t.groups {
+		g := &t.groups[i]
+		gs := snap.Groups[i]
+
+		readedReal, err := utils.NewBitMapFromBytes(gs.ReadedFilesReal, g.group.fileNum)
+		if err != nil {
+			return err
+		}
+		readedCache, err := utils.NewBitMapFromBytes(gs.ReadedFilesCache, g.group.fileNum)
+		if err != nil {
+			return err
+		}
+
+		g.lock.Lock()
+		g.readedFilesReal = readedReal
+		g.readedFilesCache = readedCache
+		g.unreadFileNum = gs.UnreadFileNum
+		g.unreadFiles = gs.UnreadFiles
+		g.unreadFilesIndexs = gs.UnreadFilesIndexs
+		g.readedCachedFileNum = gs.ReadedCachedFileNum
+		g.readedCachedFiles = gs.ReadedCachedFiles
+		g.prereadFileNum = gs.PrereadFileNum
+		g.cachedFileNum = gs.CachedFileNum
+		g.cacheedFilesCache = gs.CacheedFilesCache
+		g.cachedFiles = gs.CachedFiles
+		g.policy.Restore(gs.Policy)
+
+		// Persist only snapshots which fileIds were cached, never their
+		// payloads (chunk manifests, ChunkStore bytes, dataset.cachedFiles
+		// entries). Drop any restored entry that isn't actually backed by
+		// data in this process, rather than leaving bookkeeping that
+		// claims it's servable when getFileFromCache would just error.
+		g.evictUnbackedCachedFiles()
+		g.lock.Unlock()
+	}
+
+	return nil
+}
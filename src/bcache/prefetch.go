@@ -0,0 +1,275 @@
+// Copyright 2020 Baidu, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package bcache
+
+import (
+	"container/heap"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	// used to size the first in-flight budget reservation, before we've
+	// actually observed any FileNode from this group
+	defaultAvgFileSize = 64 * 1024
+)
+
+// prefetchItem is one unreadFiles candidate waiting to be fetched in the
+// background. Lower fileId sorts first, so a group is warmed roughly in
+// read order.
+type prefetchItem struct {
+	fileId uint32
+}
+
+type prefetchQueue []*prefetchItem
+
+func (q prefetchQueue) Len() int            { return len(q) }
+func (q prefetchQueue) Less(i, j int) bool  { return q[i].fileId < q[j].fileId }
+func (q prefetchQueue) Swap(i, j int)       { q[i], q[j] = q[j], q[i] }
+func (q *prefetchQueue) Push(x interface{}) { *q = append(*q, x.(*prefetchItem)) }
+func (q *prefetchQueue) Pop() interface{} {
+	old := *q
+	n := len(old)
+	item := old[n-1]
+	*q = old[:n-1]
+	return item
+}
+
+// PrefetchMetrics is a point-in-time snapshot of a Prefetcher's activity.
+type PrefetchMetrics struct {
+	Hits       uint64
+	Misses     uint64
+	InFlight   int64 // reserved against cacheBudget: fetches in progress plus already-cached prefetch hits
+	QueueDepth int
+}
+
+// HitRate returns the fraction of completed prefetches that actually
+// found the file (vs. a backend/peer miss), or 0 if nothing completed yet.
+func (m PrefetchMetrics) HitRate() float64 {
+	total := m.Hits + m.Misses
+	if total == 0 {
+		return 0
+	}
+	return float64(m.Hits) / float64(total)
+}
+
+// Prefetcher runs a bounded worker pool that warms one DLTGroup's cache
+// in the background, pulling candidates out of unreadFiles and handing
+// completed FileNodes to addFileToCache out of order - whichever file
+// lands first is served first, same as restic's out-of-order blob
+// restore.
+type Prefetcher struct {
+	dlt     *DLT
+	groupId uint32
+
+	concurrency int
+	sem         chan struct{}
+
+	qLock sync.Mutex
+	queue prefetchQueue
+
+	avgFileSize int64 // exponential moving average, used to size reservations
+
+	// inFlightBytes is bytes reserved against cacheBudget: an estimate
+	// while a fetch is running, the real node size once it lands in the
+	// cache. Only released back on a miss/error, since a successful
+	// prefetch keeps its space occupied for as long as it stays cached.
+	inFlightBytes int64
+	cacheBudget   int64 // allowCacheSize - cachedSize, snapshotted at Start
+
+	hits, misses uint64
+
+	// wake is notified (non-blocking) every time a fetch finishes,
+	// freeing up budget or a concurrency slot. dispatch blocks on it
+	// instead of busy-looping while waiting for headroom.
+	wake chan struct{}
+
+	stopCh chan struct{}
+	wg     sync.WaitGroup
+}
+
+// NewPrefetcher builds a prefetcher for one group of dlt. concurrency is
+// the number of backend/peer fetches allowed to be in flight at once.
+func NewPrefetcher(dlt *DLT, groupId uint32, concurrency int) *Prefetcher {
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+	return &Prefetcher{
+		dlt:         dlt,
+		groupId:     groupId,
+		concurrency: concurrency,
+		avgFileSize: defaultAvgFileSize,
+		wake:        make(chan struct{}, 1),
+		stopCh:      make(chan struct{}),
+	}
+}
+
+// Start seeds the priority queue from the group's current unreadFiles
+// pool and launches the dispatcher goroutine. Safe to call once.
+func (p *Prefetcher) Start() {
+	group := &p.dlt.groups[p.groupId]
+
+	group.lock.Lock()
+	p.cacheBudget = int64(group.group.allowCacheSize) - int64(group.group.cachedSize)
+	for i := uint32(0); i < group.unreadFileNum; i++ {
+		heap.Push(&p.queue, &prefetchItem{fileId: group.unreadFiles[i]})
+	}
+	group.lock.Unlock()
+
+	p.sem = make(chan struct{}, p.concurrency)
+
+	p.wg.Add(1)
+	go p.dispatch()
+}
+
+// Stop drains in-flight fetches and stops the dispatcher. Queued
+// candidates that never got picked up stay in unreadFiles, untouched.
+func (p *Prefetcher) Stop() {
+	close(p.stopCh)
+	p.wg.Wait()
+}
+
+func (p *Prefetcher) dispatch() {
+	defer p.wg.Done()
+	group := &p.dlt.groups[p.groupId]
+
+	for {
+		select {
+		case <-p.stopCh:
+			return
+		default:
+		}
+
+		p.qLock.Lock()
+		if p.queue.Len() == 0 {
+			p.qLock.Unlock()
+			return
+		}
+		if atomic.LoadInt64(&p.inFlightBytes)+atomic.LoadInt64(&p.avgFileSize) > p.cacheBudget {
+			// No headroom left in the group's cache budget. Block until a
+			// fetch actually completes and frees some, or we're stopped.
+			// If nothing is in flight (e.g. cacheBudget itself is too
+			// small to ever fit one file), wake is never signaled and we
+			// simply park here instead of spinning.
+			p.qLock.Unlock()
+			select {
+			case <-p.stopCh:
+				return
+			case <-p.wake:
+			}
+			continue
+		}
+		item := heap.Pop(&p.queue).(*prefetchItem)
+		p.qLock.Unlock()
+
+		group.lock.Lock()
+		ok := group.popUnreadForPreread(item.fileId)
+		group.lock.Unlock()
+		if !ok {
+			// already claimed by a synchronous reader or evicted
+			continue
+		}
+
+		select {
+		case p.sem <- struct{}{}:
+		case <-p.stopCh:
+			group.lock.Lock()
+			group.addUnreadedFile(item.fileId)
+			group.lock.Unlock()
+			return
+		}
+
+		estimate := atomic.LoadInt64(&p.avgFileSize)
+		atomic.AddInt64(&p.inFlightBytes, estimate)
+
+		p.wg.Add(1)
+		go p.fetch(item.fileId, estimate)
+	}
+}
+
+func (p *Prefetcher) fetch(fileId uint32, estimate int64) {
+	defer p.wg.Done()
+	defer func() { <-p.sem }()
+	defer p.notifyWake()
+
+	group := &p.dlt.groups[p.groupId]
+
+	node, err := p.dlt.fetchFile(p.groupId, fileId)
+
+	if err != nil || node == nil {
+		// nothing was actually cached, so release the reservation in
+		// full - it never left headroom for anything else.
+		atomic.AddInt64(&p.inFlightBytes, -estimate)
+		atomic.AddUint64(&p.misses, 1)
+		// put it back so a synchronous Get() (or a later prefetch pass)
+		// can still find it in unreadFiles
+		group.lock.Lock()
+		group.addUnreadedFile(fileId)
+		group.lock.Unlock()
+		return
+	}
+
+	atomic.AddUint64(&p.hits, 1)
+	p.observeSize(int64(node.size))
+
+	// The estimate stays charged against cacheBudget now that the file
+	// is actually sitting in the cache - only the gap between the
+	// estimate and its real size is released, so a run of successful
+	// prefetches can't keep reporting full headroom and overshoot
+	// allowCacheSize.
+	atomic.AddInt64(&p.inFlightBytes, -(estimate - int64(node.size)))
+
+	group.lock.Lock()
+	p.dlt.cacheNode(fileId, node)
+	group.addFileToCache(node) // signals cond, waking anyone blocked on prereadFileNum
+	group.lock.Unlock()
+}
+
+// notifyWake pokes dispatch in case it's parked waiting for budget
+// headroom. Non-blocking: if a wake is already pending, this one is
+// redundant.
+func (p *Prefetcher) notifyWake() {
+	select {
+	case p.wake <- struct{}{}:
+	default:
+	}
+}
+
+// observeSize folds a freshly-fetched FileNode's size into the running
+// average used to size future budget reservations.
+func (p *Prefetcher) observeSize(size int64) {
+	if size <= 0 {
+		return
+	}
+	for {
+		old := atomic.LoadInt64(&p.avgFileSize)
+		next := old + (size-old)/4
+		if atomic.CompareAndSwapInt64(&p.avgFileSize, old, next) {
+			return
+		}
+	}
+}
+
+// Metrics returns a snapshot of this prefetcher's counters.
+func (p *Prefetcher) Metrics() PrefetchMetrics {
+	p.qLock.Lock()
+	depth := p.queue.Len()
+	p.qLock.Unlock()
+
+	return PrefetchMetrics{
+		Hits:       atomic.LoadUint64(&p.hits),
+		Misses:     atomic.LoadUint64(&p.misses),
+		InFlight:   atomic.LoadInt64(&p.inFlightBytes),
+		QueueDepth: depth,
+	}
+}
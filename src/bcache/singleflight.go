@@ -0,0 +1,64 @@
+// Copyright 2020 Baidu, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package bcache
+
+import (
+	"sync"
+)
+
+// call is an in-flight or completed singleFlight.Do call.
+type call struct {
+	wg  sync.WaitGroup
+	val *FileNode
+	err error
+}
+
+// singleFlight makes sure only one fetch for a given key is in flight at a
+// time; callers that arrive while a fetch is running just wait on it instead
+// of issuing a duplicate peer/backend request.
+type singleFlight struct {
+	lock  sync.Mutex
+	calls map[string]*call
+}
+
+func newSingleFlight() *singleFlight {
+	return &singleFlight{
+		calls: make(map[string]*call),
+	}
+}
+
+// Do executes fn, making sure only one execution is in-flight for a given
+// key at a time. Duplicate callers wait for the original to complete and
+// receive the same results.
+func (s *singleFlight) Do(key string, fn func() (*FileNode, error)) (*FileNode, error) {
+	s.lock.Lock()
+	if c, ok := s.calls[key]; ok {
+		s.lock.Unlock()
+		c.wg.Wait()
+		return c.val, c.err
+	}
+
+	c := new(call)
+	c.wg.Add(1)
+	s.calls[key] = c
+	s.lock.Unlock()
+
+	c.val, c.err = fn()
+	c.wg.Done()
+
+	s.lock.Lock()
+	delete(s.calls, key)
+	s.lock.Unlock()
+
+	return c.val, c.err
+}